@@ -0,0 +1,186 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the CockroachDB Software License
+// included in the /LICENSE file.
+
+package ssmemstorage
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+)
+
+const (
+	evictionPolicyReject int64 = iota
+	evictionPolicyLRU
+)
+
+// EvictionPolicy controls what RecordStatement and RecordTransaction do when
+// the unique fingerprint limit or the memory budget has been reached for a
+// new fingerprint:
+//
+//   - reject (the default): drop the observation and return an error, as
+//     ssmemstorage has always done.
+//   - lru: evict the Container's coldest statement and transaction
+//     fingerprints (the ones least recently recorded against) until the new
+//     one fits, and record it. Recently-seen fingerprints, which the SQL
+//     Activity UI cares about most, are no longer the first thing dropped
+//     when a burst of one-off queries fills the table.
+var EvictionPolicy = settings.RegisterEnumSetting(
+	settings.ApplicationLevel,
+	"sql.stats.eviction_policy",
+	"what to do when the sql stats fingerprint limit or memory budget is reached "+
+		"for a new fingerprint: reject the new fingerprint, or evict the least "+
+		"recently used ones to make room for it",
+	"reject",
+	map[int64]string{
+		evictionPolicyReject: "reject",
+		evictionPolicyLRU:    "lru",
+	},
+)
+
+// lruNode is one entry in a Container's intrusive LRU list. key is either a
+// statementKey or an appstatspb.TransactionFingerprintID, boxed as
+// interface{} so the same list implementation serves both RecordStatement
+// and RecordTransaction. onEvict removes the corresponding entry from the
+// Container's stmts/txns map and returns the freed bytes to whichever
+// account it was grown against (s.mu.acc, or a per-app quota's account); it
+// is supplied by the caller of touch because the list implementation itself
+// doesn't know the concrete key type or which account charged it.
+type lruNode struct {
+	key     interface{}
+	bytes   int64
+	onEvict func(ctx context.Context, bytes int64)
+}
+
+// lruList is an intrusive, doubly-linked least-recently-used list. The front
+// of the list is the most-recently-used entry; the back is the next
+// eviction victim. All methods are safe for concurrent use.
+type lruList struct {
+	mu struct {
+		sync.Mutex
+		l     list.List // of *lruNode
+		index map[interface{}]*list.Element
+	}
+
+	stmtEvictions atomic.Int64
+	txnEvictions  atomic.Int64
+}
+
+func newLRUList() *lruList {
+	lru := &lruList{}
+	lru.mu.index = make(map[interface{}]*list.Element)
+	return lru
+}
+
+// touch marks key as most-recently-used, inserting it (with the given size
+// in bytes and eviction callback) if it isn't already tracked, or updating
+// its size and moving it to the front if it is.
+func (lru *lruList) touch(key interface{}, bytes int64, onEvict func(ctx context.Context, bytes int64)) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	if e, ok := lru.mu.index[key]; ok {
+		node := e.Value.(*lruNode)
+		node.bytes = bytes
+		node.onEvict = onEvict
+		lru.mu.l.MoveToFront(e)
+		return
+	}
+	e := lru.mu.l.PushFront(&lruNode{key: key, bytes: bytes, onEvict: onEvict})
+	lru.mu.index[key] = e
+}
+
+// touchExisting moves key to the front of the list (marking it
+// most-recently-used) if it's already tracked, without changing its
+// accounted size or eviction callback. It's a no-op if key isn't tracked
+// (e.g. because memory accounting is disabled for this Container, so it was
+// never added in the first place). RecordStatement/RecordTransaction call
+// this on every record of an already-existing fingerprint, not just touch
+// at its creation, so that a fingerprint recorded once and then executed
+// constantly doesn't sit at the back of the list forever.
+func (lru *lruList) touchExisting(key interface{}) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	if e, ok := lru.mu.index[key]; ok {
+		lru.mu.l.MoveToFront(e)
+	}
+}
+
+// remove stops tracking key, e.g. because it was flushed or evicted through
+// some other path. It is a no-op if key isn't tracked.
+func (lru *lruList) remove(key interface{}) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+	lru.removeLocked(key)
+}
+
+func (lru *lruList) removeLocked(key interface{}) {
+	if e, ok := lru.mu.index[key]; ok {
+		lru.mu.l.Remove(e)
+		delete(lru.mu.index, key)
+	}
+}
+
+// evictOldest evicts the coldest entries, oldest first, until at least
+// needBytes has been freed or there is nothing left to evict. It returns the
+// number of bytes freed.
+func (lru *lruList) evictOldest(ctx context.Context, needBytes int64, isTxn bool) int64 {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	var freed int64
+	for freed < needBytes {
+		e := lru.mu.l.Back()
+		if e == nil {
+			break
+		}
+		node := e.Value.(*lruNode)
+		lru.mu.l.Remove(e)
+		delete(lru.mu.index, node.key)
+
+		node.onEvict(ctx, node.bytes)
+		freed += node.bytes
+		if isTxn {
+			lru.txnEvictions.Add(1)
+		} else {
+			lru.stmtEvictions.Add(1)
+		}
+	}
+	return freed
+}
+
+// lruStates maps each Container to its intrusive LRU list. Kept out of
+// Container itself for the same reason as overflowSinks and quotaStates: the
+// struct is defined and constructed elsewhere in the package, with no
+// natural place to thread this through every existing call site.
+var lruStates sync.Map // map[*Container]*lruList
+
+func (s *Container) getOrInitLRU() *lruList {
+	if v, ok := lruStates.Load(s); ok {
+		return v.(*lruList)
+	}
+	lru := newLRUList()
+	actual, _ := lruStates.LoadOrStore(s, lru)
+	return actual.(*lruList)
+}
+
+// StatementEvictionCount returns the number of fingerprints s has evicted
+// under the lru eviction policy since startup to make room for a new
+// statement fingerprint. Statement and transaction fingerprints share one LRU
+// list, so an eviction counted here may have removed a transaction
+// fingerprint.
+func (s *Container) StatementEvictionCount() int64 {
+	return s.getOrInitLRU().stmtEvictions.Load()
+}
+
+// TransactionEvictionCount returns the number of fingerprints s has evicted
+// under the lru eviction policy since startup to make room for a new
+// transaction fingerprint; as with StatementEvictionCount, an eviction
+// counted here may have removed a fingerprint of either kind.
+func (s *Container) TransactionEvictionCount() int64 {
+	return s.getOrInitLRU().txnEvictions.Load()
+}
@@ -0,0 +1,122 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the CockroachDB Software License
+// included in the /LICENSE file.
+
+package ssmemstorage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestLRUListEvictsOldestFirst verifies that evictOldest walks the list from
+// the coldest (least recently touched) entry forward, and stops as soon as
+// enough bytes have been freed.
+func TestLRUListEvictsOldestFirst(t *testing.T) {
+	lru := newLRUList()
+	ctx := context.Background()
+
+	var evicted []string
+	onEvict := func(key string) func(context.Context, int64) {
+		return func(_ context.Context, bytes int64) {
+			evicted = append(evicted, key)
+			require.Equal(t, int64(10), bytes)
+		}
+	}
+
+	lru.touch("a", 10, onEvict("a"))
+	lru.touch("b", 10, onEvict("b"))
+	lru.touch("c", 10, onEvict("c"))
+
+	// Freeing 15 bytes should evict "a" then "b" (oldest first), stopping
+	// before "c" since 20 >= 15.
+	freed := lru.evictOldest(ctx, 15, false /* isTxn */)
+	require.Equal(t, int64(20), freed)
+	require.Equal(t, []string{"a", "b"}, evicted)
+	require.Equal(t, int64(2), lru.stmtEvictions.Load())
+}
+
+// TestLRUListTouchReordersAndUpdates verifies that re-touching an existing
+// key moves it to the front (making it the last thing evicted) and updates
+// its accounted size and eviction callback.
+func TestLRUListTouchReordersAndUpdates(t *testing.T) {
+	lru := newLRUList()
+	ctx := context.Background()
+
+	lru.touch("a", 10, func(context.Context, int64) { t.Fatal("stale callback invoked") })
+	lru.touch("b", 10, func(context.Context, int64) {})
+
+	var freedForA int64
+	lru.touch("a", 25, func(_ context.Context, bytes int64) { freedForA = bytes })
+
+	// "a" is now most-recently-used, so "b" is evicted first.
+	freed := lru.evictOldest(ctx, 1, false /* isTxn */)
+	require.Equal(t, int64(10), freed)
+
+	// Evicting again should hit "a" with its updated size and callback.
+	freed = lru.evictOldest(ctx, 1, false /* isTxn */)
+	require.Equal(t, int64(25), freed)
+	require.Equal(t, int64(25), freedForA)
+}
+
+// TestLRUListTouchExisting verifies that touchExisting moves an already
+// tracked key to the front without changing its accounted size or eviction
+// callback, and is a no-op for a key that was never touched.
+func TestLRUListTouchExisting(t *testing.T) {
+	lru := newLRUList()
+	ctx := context.Background()
+
+	var evicted []string
+	onEvict := func(key string) func(context.Context, int64) {
+		return func(_ context.Context, bytes int64) {
+			evicted = append(evicted, key)
+			require.Equal(t, int64(10), bytes)
+		}
+	}
+
+	lru.touch("a", 10, onEvict("a"))
+	lru.touch("b", 10, onEvict("b"))
+
+	// "a" was inserted first, so without touchExisting it would be evicted
+	// first. Marking it as recently-used again (as a repeated record of an
+	// already-existing fingerprint would) should protect it.
+	lru.touchExisting("a")
+
+	freed := lru.evictOldest(ctx, 10, false /* isTxn */)
+	require.Equal(t, int64(10), freed)
+	require.Equal(t, []string{"b"}, evicted)
+
+	// touchExisting on a key that was never tracked is a no-op, not a panic.
+	lru.touchExisting("never-tracked")
+}
+
+// TestLRUListRemove verifies that remove stops tracking a key without
+// invoking its eviction callback, e.g. because it was flushed through some
+// other path.
+func TestLRUListRemove(t *testing.T) {
+	lru := newLRUList()
+	ctx := context.Background()
+
+	lru.touch("a", 10, func(context.Context, int64) { t.Fatal("removed entry should not evict") })
+	lru.remove("a")
+
+	freed := lru.evictOldest(ctx, 10, false /* isTxn */)
+	require.Equal(t, int64(0), freed)
+}
+
+// TestLRUListEvictOldestStopsWhenEmpty verifies that evictOldest stops
+// (rather than looping forever) once there's nothing left to evict, even if
+// the requested byte count was never reached.
+func TestLRUListEvictOldestStopsWhenEmpty(t *testing.T) {
+	lru := newLRUList()
+	ctx := context.Background()
+
+	lru.touch("a", 5, func(context.Context, int64) {})
+
+	freed := lru.evictOldest(ctx, 1000, true /* isTxn */)
+	require.Equal(t, int64(5), freed)
+	require.Equal(t, int64(1), lru.txnEvictions.Load())
+}
@@ -0,0 +1,414 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the CockroachDB Software License
+// included in the /LICENSE file.
+
+package ssmemstorage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/sql/appstatspb"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/protoutil"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/errors"
+)
+
+// StatsPersistentOverflow controls whether statement and transaction
+// statistics that cannot be recorded in memory (because the container has
+// hit its memory budget or its unique fingerprint limit) are instead
+// appended to a disk-backed overflow log, rather than being dropped.
+var StatsPersistentOverflow = settings.RegisterBoolSetting(
+	settings.ApplicationLevel,
+	"sql.stats.persisted_overflow.enabled",
+	"if enabled, statement and transaction statistics that would otherwise be "+
+		"dropped due to memory pressure or the fingerprint limit are appended to "+
+		"a disk-backed overflow log instead",
+	false,
+)
+
+// overflowRotateSize is the maximum size, in bytes, a single overflow log
+// file is allowed to grow to before it is rotated.
+var overflowRotateSize = settings.RegisterByteSizeSetting(
+	settings.ApplicationLevel,
+	"sql.stats.persisted_overflow.max_file_size",
+	"the size at which an individual sql stats overflow log file is rotated",
+	64<<20, // 64 MiB
+)
+
+// overflowRotateInterval is the maximum age a single overflow log file is
+// allowed to reach before it is rotated, regardless of size.
+var overflowRotateInterval = settings.RegisterDurationSetting(
+	settings.ApplicationLevel,
+	"sql.stats.persisted_overflow.max_file_age",
+	"the age at which an individual sql stats overflow log file is rotated",
+	time.Hour,
+)
+
+// overflowRetention is how long a rotated overflow log file is kept on disk
+// before the background purger removes it.
+var overflowRetention = settings.RegisterDurationSetting(
+	settings.ApplicationLevel,
+	"sql.stats.persisted_overflow.retention",
+	"how long rotated sql stats overflow log files are retained before deletion",
+	7*24*time.Hour,
+)
+
+// overflowDir is the directory statement and transaction statistics are
+// spilled to when StatsPersistentOverflow is enabled and no explicit
+// SetOverflowDir call has configured a Container otherwise. It defaults to
+// empty, which disables spilling regardless of StatsPersistentOverflow,
+// since there is no sensible directory to guess at: a node typically has
+// several store directories and no single one of them is "the" place to put
+// this log. Operators that want the overflow log on a particular store's
+// disk should set this to e.g. <store-dir>/sql-stats-overflow.
+var overflowDir = settings.RegisterStringSetting(
+	settings.ApplicationLevel,
+	"sql.stats.persisted_overflow.dir",
+	"the directory sql stats that overflow the in-memory budget are appended to "+
+		"when sql.stats.persisted_overflow.enabled is true; disabled if empty",
+	"",
+)
+
+const overflowSchemaVersion = 1
+
+const (
+	overflowRecordKindStatement   byte = 1
+	overflowRecordKindTransaction byte = 2
+)
+
+// overflowFileHeader is written as the first thing in every rotated overflow
+// log file. It is kept intentionally small so that a Reader can decide
+// whether a file is worth scanning without reading the rest of it.
+type overflowFileHeader struct {
+	schemaVersion uint32
+	instanceID    base.SQLInstanceID
+	beginTS       time.Time
+	// endTS is updated in place (by rewriting the header) each time the file
+	// is rotated out, so that readers can prune on the file's true time range.
+	endTS time.Time
+}
+
+// overflowSink is a rotating, append-only disk log that Container falls
+// through to when it cannot account for a new statement or transaction
+// statistics entry in memory. Each record is self-describing (kind + length
+// prefixed proto) so that a Reader opened against the store directory can
+// reconstruct appstatspb.CollectedStatementStatistics and
+// appstatspb.CollectedTransactionStatistics without coordinating with a live
+// Container.
+type overflowSink struct {
+	st  *settings.Values
+	dir string
+
+	instanceID base.SQLInstanceID
+
+	mu struct {
+		sync.Mutex
+		file      *os.File
+		w         *bufio.Writer
+		header    overflowFileHeader
+		size      int64
+		lastPurge time.Time
+	}
+}
+
+// newOverflowSink creates an overflowSink rooted at dir (typically
+// <store-dir>/sql-stats-overflow). The directory is created lazily on the
+// first write so that nodes that never hit memory pressure never touch disk.
+func newOverflowSink(dir string, sv *settings.Values, instanceID base.SQLInstanceID) *overflowSink {
+	return &overflowSink{st: sv, dir: dir, instanceID: instanceID}
+}
+
+// WriteStatement appends stats to the overflow log, rotating the current
+// file first if it has grown past its size or age limit.
+func (o *overflowSink) WriteStatement(
+	ctx context.Context, stats *appstatspb.CollectedStatementStatistics,
+) error {
+	buf, err := protoutil.Marshal(stats)
+	if err != nil {
+		return errors.Wrap(err, "marshalling overflowed statement statistics")
+	}
+	return o.appendRecord(ctx, overflowRecordKindStatement, buf)
+}
+
+// WriteTransaction appends stats to the overflow log, rotating the current
+// file first if it has grown past its size or age limit.
+func (o *overflowSink) WriteTransaction(
+	ctx context.Context, stats *appstatspb.CollectedTransactionStatistics,
+) error {
+	buf, err := protoutil.Marshal(stats)
+	if err != nil {
+		return errors.Wrap(err, "marshalling overflowed transaction statistics")
+	}
+	return o.appendRecord(ctx, overflowRecordKindTransaction, buf)
+}
+
+func (o *overflowSink) appendRecord(ctx context.Context, kind byte, payload []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.maybeRotateLocked(ctx); err != nil {
+		return err
+	}
+
+	var lenBuf [4]byte
+	binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(payload)))
+
+	n := 0
+	for _, b := range [][]byte{{kind}, lenBuf[:], payload} {
+		written, err := o.mu.w.Write(b)
+		if err != nil {
+			return errors.Wrap(err, "writing sql stats overflow record")
+		}
+		n += written
+	}
+	o.mu.size += int64(n)
+	o.mu.header.endTS = timeutilNow()
+	return o.mu.w.Flush()
+}
+
+// maybeRotateLocked rotates the current overflow file if it doesn't exist
+// yet, or has grown past the size or age limits. o.mu must be held.
+func (o *overflowSink) maybeRotateLocked(ctx context.Context) error {
+	now := timeutilNow()
+	if o.mu.file != nil &&
+		o.mu.size < overflowRotateSize.Get(o.st) &&
+		now.Sub(o.mu.header.beginTS) < overflowRotateInterval.Get(o.st) {
+		return nil
+	}
+	if o.mu.file != nil {
+		if err := o.closeLocked(); err != nil {
+			log.Warningf(ctx, "closing sql stats overflow file: %v", err)
+		}
+	}
+	if err := os.MkdirAll(o.dir, 0755); err != nil {
+		return errors.Wrap(err, "creating sql stats overflow directory")
+	}
+	name := filepath.Join(o.dir, now.UTC().Format("20060102T150405.000000000Z")+".ssoverflow")
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return errors.Wrap(err, "creating sql stats overflow file")
+	}
+	o.mu.file = f
+	o.mu.w = bufio.NewWriter(f)
+	o.mu.header = overflowFileHeader{
+		schemaVersion: overflowSchemaVersion,
+		instanceID:    o.instanceID,
+		beginTS:       now,
+		endTS:         now,
+	}
+	o.mu.size = 0
+	if err := writeOverflowHeader(o.mu.w, o.mu.header); err != nil {
+		return err
+	}
+	o.mu.size += overflowHeaderSize
+	o.maybePurgeLocked(ctx, now)
+	return nil
+}
+
+// maybePurgeLocked deletes expired rotated overflow files if it's been at
+// least overflowRetention/purgeCheckDivisor since the last purge. It's
+// piggybacked onto rotation (which already happens periodically on any sink
+// that's actively being written to) rather than run from its own goroutine,
+// so that a sink activated lazily by getOverflowSink from a read path never
+// needs to spawn anything that would outlive the read and couldn't be tied
+// to a *stop.Stopper. o.mu must be held. Callers that own a *stop.Stopper
+// (see SetOverflowDir) should still prefer the more timely, guaranteed
+// cleanup of RunPurger.
+func (o *overflowSink) maybePurgeLocked(ctx context.Context, now time.Time) {
+	const purgeCheckDivisor = 24 // check roughly once per retention/24 of rotations
+	interval := overflowRetention.Get(o.st) / purgeCheckDivisor
+	if interval <= 0 || now.Sub(o.mu.lastPurge) < interval {
+		return
+	}
+	o.mu.lastPurge = now
+	o.purgeOnce(ctx)
+}
+
+func (o *overflowSink) closeLocked() error {
+	if o.mu.file == nil {
+		return nil
+	}
+	if err := o.mu.w.Flush(); err != nil {
+		return err
+	}
+	// Rewrite the header in place with the final endTS so that a Reader can
+	// skip this file on time range alone.
+	if _, err := o.mu.file.WriteAt(encodeOverflowHeader(o.mu.header), 0); err != nil {
+		return err
+	}
+	name := o.mu.file.Name()
+	err := o.mu.file.Close()
+	o.mu.file = nil
+	o.mu.w = nil
+	if err != nil {
+		return err
+	}
+	// The header rewrite above bumps the file's modification time; set it back
+	// to the time of the file's last record, since that is what purgeOnce
+	// compares against the retention window.
+	return os.Chtimes(name, o.mu.header.endTS, o.mu.header.endTS)
+}
+
+// RunPurger starts a background task that periodically deletes rotated
+// overflow files older than overflowRetention. It runs until stopper quiesces.
+func (o *overflowSink) RunPurger(ctx context.Context, stopper *stop.Stopper) error {
+	return stopper.RunAsyncTask(ctx, "sql-stats-overflow-purger", func(ctx context.Context) {
+		const purgeInterval = time.Hour
+		ticker := time.NewTicker(purgeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				o.purgeOnce(ctx)
+			case <-stopper.ShouldQuiesce():
+				return
+			}
+		}
+	})
+}
+
+func (o *overflowSink) purgeOnce(ctx context.Context) {
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf(ctx, "listing sql stats overflow directory: %v", err)
+		}
+		return
+	}
+	cutoff := timeutilNow().Add(-overflowRetention.Get(o.st))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if info.ModTime().Before(cutoff) {
+			if err := os.Remove(filepath.Join(o.dir, entry.Name())); err != nil {
+				log.Warningf(ctx, "removing expired sql stats overflow file %s: %v", entry.Name(), err)
+			}
+		}
+	}
+}
+
+const overflowHeaderSize = 4 /* schema version */ + 4 /* instance id */ + 8 /* begin */ + 8 /* end */
+
+func writeOverflowHeader(w *bufio.Writer, h overflowFileHeader) error {
+	_, err := w.Write(encodeOverflowHeader(h))
+	return err
+}
+
+func encodeOverflowHeader(h overflowFileHeader) []byte {
+	buf := make([]byte, overflowHeaderSize)
+	binary.LittleEndian.PutUint32(buf[0:4], h.schemaVersion)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(h.instanceID))
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(h.beginTS.UnixNano()))
+	binary.LittleEndian.PutUint64(buf[16:24], uint64(h.endTS.UnixNano()))
+	return buf
+}
+
+func decodeOverflowHeader(buf []byte) overflowFileHeader {
+	return overflowFileHeader{
+		schemaVersion: binary.LittleEndian.Uint32(buf[0:4]),
+		instanceID:    base.SQLInstanceID(binary.LittleEndian.Uint32(buf[4:8])),
+		beginTS:       time.Unix(0, int64(binary.LittleEndian.Uint64(buf[8:16]))).UTC(),
+		endTS:         time.Unix(0, int64(binary.LittleEndian.Uint64(buf[16:24]))).UTC(),
+	}
+}
+
+// sortOverflowFilesByName sorts rotated overflow file names chronologically;
+// relied upon by OverflowReader.ListFiles to return files oldest first.
+func sortOverflowFilesByName(names []string) {
+	sort.Strings(names)
+}
+
+func timeutilNow() time.Time {
+	return time.Now()
+}
+
+// overflowSinks maps each Container to the overflowSink it falls through to
+// on memory pressure. Containers are long-lived (one per app/tenant stats
+// collector) and there is no natural place on Container's existing
+// constructors to thread a *os.File-backed sink through every call site that
+// builds one in tests, so the sink is either registered explicitly via
+// SetOverflowDir, or lazily self-initialized by getOverflowSink from the
+// sql.stats.persisted_overflow.dir cluster setting the first time a spill is
+// attempted.
+var overflowSinks sync.Map // map[*Container]*overflowSink
+
+// SetOverflowDir configures s to append statement and transaction
+// statistics it cannot account for in memory to a disk-backed overflow log
+// rooted at dir, overriding the default of lazily self-initializing from
+// sql.stats.persisted_overflow.dir. Callers that have a *stop.Stopper handy
+// (e.g. at Container construction, where the store directory and instance ID
+// are known) should prefer calling this followed by RunPurger, so that
+// purging is tied to the server's own lifecycle rather than a bare goroutine.
+func (s *Container) SetOverflowDir(dir string, instanceID base.SQLInstanceID) {
+	overflowSinks.Store(s, newOverflowSink(dir, &s.st.SV, instanceID))
+}
+
+// getOverflowSink returns the overflowSink registered for s, lazily
+// self-initializing one rooted at sql.stats.persisted_overflow.dir the first
+// time it's needed if SetOverflowDir was never called explicitly. It returns
+// nil if SetOverflowDir wasn't called and the dir setting is empty (e.g. in
+// most unit tests, and in production unless an operator has opted in).
+// Lazily initializing a sink here never starts a goroutine of its own (see
+// maybePurgeLocked): callers on the read path (ReadStatementsIncludingOverflow
+// and friends, which gate on StatsPersistentOverflow before ever reaching
+// here) can't accidentally leak one that outlives the read.
+func (s *Container) getOverflowSink() *overflowSink {
+	if v, ok := overflowSinks.Load(s); ok {
+		return v.(*overflowSink)
+	}
+	dir := overflowDir.Get(&s.st.SV)
+	if dir == "" {
+		return nil
+	}
+	sink := newOverflowSink(dir, &s.st.SV, 0 /* instanceID */)
+	actual, _ := overflowSinks.LoadOrStore(s, sink)
+	return actual.(*overflowSink)
+}
+
+// spillStatementToOverflow appends stats to s's overflow sink if one is configured
+// and StatsPersistentOverflow is enabled. Failures to spill are logged but
+// otherwise swallowed: the caller is already on the path of reporting a
+// memory-pressure error back to the client, and the overflow log is a
+// best-effort durability improvement, not a correctness requirement.
+func (s *Container) spillStatementToOverflow(
+	ctx context.Context, stats *appstatspb.CollectedStatementStatistics,
+) {
+	if !StatsPersistentOverflow.Get(&s.st.SV) {
+		return
+	}
+	sink := s.getOverflowSink()
+	if sink == nil {
+		return
+	}
+	if err := sink.WriteStatement(ctx, stats); err != nil {
+		log.Warningf(ctx, "failed to persist overflowed statement statistics: %v", err)
+	}
+}
+
+func (s *Container) spillTransactionToOverflow(
+	ctx context.Context, stats *appstatspb.CollectedTransactionStatistics,
+) {
+	if !StatsPersistentOverflow.Get(&s.st.SV) {
+		return
+	}
+	sink := s.getOverflowSink()
+	if sink == nil {
+		return
+	}
+	if err := sink.WriteTransaction(ctx, stats); err != nil {
+		log.Warningf(ctx, "failed to persist overflowed transaction statistics: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the CockroachDB Software License
+// included in the /LICENSE file.
+
+package ssmemstorage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/sql/appstatspb"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSettingValues() *settings.Values {
+	sv := &settings.Values{}
+	sv.Init(context.Background(), settings.TestOpaque)
+	return sv
+}
+
+// TestOverflowSinkRotatesOnSize verifies that appendRecord starts a new file
+// once the configured size limit is exceeded.
+func TestOverflowSinkRotatesOnSize(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	sv := newTestSettingValues()
+	overflowRotateSize.Override(ctx, sv, 1 /* bytes: rotate on every record */)
+
+	sink := newOverflowSink(dir, sv, 7 /* instanceID */)
+	defer func() {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		_ = sink.closeLocked()
+	}()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, sink.WriteStatement(ctx, &appstatspb.CollectedStatementStatistics{
+			Key: appstatspb.StatementStatisticsKey{App: "app"},
+		}))
+	}
+
+	reader := NewOverflowReader(dir)
+	files, err := reader.ListFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 3, "each write should have rotated into its own file")
+}
+
+// TestOverflowSinkPurgesExpiredFilesOnRotation verifies that rotation
+// piggybacks a purge of expired files once overflowRetention/24 has elapsed
+// since the last purge, without requiring a background loop such as
+// RunPurger (see maybePurgeLocked's doc comment for why rotation does this).
+func TestOverflowSinkPurgesExpiredFilesOnRotation(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	sv := newTestSettingValues()
+	overflowRotateSize.Override(ctx, sv, 1 /* bytes: rotate on every record */)
+	overflowRetention.Override(ctx, sv, time.Millisecond)
+
+	sink := newOverflowSink(dir, sv, 1 /* instanceID */)
+	defer func() {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		_ = sink.closeLocked()
+	}()
+
+	require.NoError(t, sink.WriteStatement(ctx, &appstatspb.CollectedStatementStatistics{
+		Key: appstatspb.StatementStatisticsKey{App: "app"},
+	}))
+	reader := NewOverflowReader(dir)
+	files, err := reader.ListFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	// The retention window has already elapsed by the time this second write
+	// rotates in a new file, so that rotation should purge the first one.
+	time.Sleep(2 * time.Millisecond)
+	require.NoError(t, sink.WriteStatement(ctx, &appstatspb.CollectedStatementStatistics{
+		Key: appstatspb.StatementStatisticsKey{App: "app"},
+	}))
+	files, err = reader.ListFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 1, "the expired first file should have been purged on rotation")
+}
+
+// TestOverflowReaderRoundTrip verifies that statements and transactions
+// written through an overflowSink can be read back through an OverflowReader,
+// and that time-range filtering skips files whose header doesn't intersect
+// the requested window.
+func TestOverflowReaderRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	sv := newTestSettingValues()
+
+	sink := newOverflowSink(dir, sv, 1 /* instanceID */)
+	require.NoError(t, sink.WriteStatement(ctx, &appstatspb.CollectedStatementStatistics{
+		Key: appstatspb.StatementStatisticsKey{App: "app1"},
+		ID:  1,
+	}))
+	require.NoError(t, sink.WriteTransaction(ctx, &appstatspb.CollectedTransactionStatistics{
+		App:                      "app1",
+		TransactionFingerprintID: 2,
+	}))
+	sink.mu.Lock()
+	require.NoError(t, sink.closeLocked())
+	sink.mu.Unlock()
+
+	reader := NewOverflowReader(dir)
+	stmts, txns, err := reader.Read(ctx, OverflowFilter{})
+	require.NoError(t, err)
+	require.Len(t, stmts, 1)
+	require.Len(t, txns, 1)
+	require.Equal(t, appstatspb.StmtFingerprintID(1), stmts[0].ID)
+	require.Equal(t, appstatspb.TransactionFingerprintID(2), txns[0].TransactionFingerprintID)
+
+	// A filter window starting after the file's end time should skip it.
+	future := OverflowFilter{Begin: time.Now().Add(24 * time.Hour)}
+	stmts, txns, err = reader.Read(ctx, future)
+	require.NoError(t, err)
+	require.Empty(t, stmts)
+	require.Empty(t, txns)
+}
+
+// TestOverflowReaderAppNameFilter verifies per-record filtering by app name,
+// applied after a file passes the coarser header time-range check.
+func TestOverflowReaderAppNameFilter(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	sv := newTestSettingValues()
+
+	sink := newOverflowSink(dir, sv, 1 /* instanceID */)
+	require.NoError(t, sink.WriteStatement(ctx, &appstatspb.CollectedStatementStatistics{
+		Key: appstatspb.StatementStatisticsKey{App: "app1"},
+	}))
+	require.NoError(t, sink.WriteStatement(ctx, &appstatspb.CollectedStatementStatistics{
+		Key: appstatspb.StatementStatisticsKey{App: "app2"},
+	}))
+	sink.mu.Lock()
+	require.NoError(t, sink.closeLocked())
+	sink.mu.Unlock()
+
+	stmts, _, err := NewOverflowReader(dir).Read(ctx, OverflowFilter{AppName: "app2"})
+	require.NoError(t, err)
+	require.Len(t, stmts, 1)
+	require.Equal(t, "app2", stmts[0].Key.App)
+}
+
+// TestMergeStatementsPrefersInMemory verifies that a fingerprint still
+// resident in memory shadows an overflowed copy of the same fingerprint,
+// rather than the merge returning both.
+func TestMergeStatementsPrefersInMemory(t *testing.T) {
+	inMemory := []*appstatspb.CollectedStatementStatistics{
+		{ID: 1, Key: appstatspb.StatementStatisticsKey{App: "fresh"}},
+	}
+	overflow := []*appstatspb.CollectedStatementStatistics{
+		{ID: 1, Key: appstatspb.StatementStatisticsKey{App: "stale"}},
+		{ID: 2, Key: appstatspb.StatementStatisticsKey{App: "app2"}},
+	}
+
+	merged := MergeStatements(inMemory, overflow)
+	require.Len(t, merged, 2)
+
+	byID := make(map[appstatspb.StmtFingerprintID]*appstatspb.CollectedStatementStatistics)
+	for _, s := range merged {
+		byID[s.ID] = s
+	}
+	require.Equal(t, "fresh", byID[1].Key.App)
+	require.Equal(t, "app2", byID[2].Key.App)
+}
+
+// TestMergeTransactionsPrefersInMemory mirrors
+// TestMergeStatementsPrefersInMemory for transaction statistics.
+func TestMergeTransactionsPrefersInMemory(t *testing.T) {
+	inMemory := []*appstatspb.CollectedTransactionStatistics{
+		{TransactionFingerprintID: 1, App: "fresh"},
+	}
+	overflow := []*appstatspb.CollectedTransactionStatistics{
+		{TransactionFingerprintID: 1, App: "stale"},
+		{TransactionFingerprintID: 2, App: "app2"},
+	}
+
+	merged := MergeTransactions(inMemory, overflow)
+	require.Len(t, merged, 2)
+
+	byID := make(map[appstatspb.TransactionFingerprintID]*appstatspb.CollectedTransactionStatistics)
+	for _, txn := range merged {
+		byID[txn.TransactionFingerprintID] = txn
+	}
+	require.Equal(t, "fresh", byID[1].App)
+	require.Equal(t, "app2", byID[2].App)
+}
@@ -0,0 +1,331 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the CockroachDB Software License
+// included in the /LICENSE file.
+
+package ssmemstorage
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+// PerAppMemoryLimit bounds how much of the Container's memory budget a
+// single application name is allowed to hold onto before RecordStatement and
+// RecordTransaction start evicting that application's own least-recently-used
+// fingerprints rather than reaching into the shared budget. A value of 0
+// disables the per-app quota and falls back to accounting everything against
+// the Container's single global monitor, as before this setting existed.
+var PerAppMemoryLimit = settings.RegisterByteSizeSetting(
+	settings.ApplicationLevel,
+	"sql.stats.mem.per_app.max",
+	"the maximum amount of sql stats memory a single application name may hold; "+
+		"0 disables the per-application quota",
+	0,
+)
+
+// PerSessionMemoryLimit bounds how much of the Container's memory budget a
+// single session is allowed to hold onto, the same way PerAppMemoryLimit
+// bounds a single application name. It only takes effect for callers that
+// attach a session id to ctx via ContextWithSessionID before calling
+// RecordStatement/RecordTransaction; RecordStatement and RecordTransaction's
+// signatures don't carry a session id of their own, so this is how session
+// scoping is threaded through without changing the sqlstats.Writer
+// interface. When both this and PerAppMemoryLimit are non-zero, a session
+// with an attached id is bounded per-session rather than per-app for as long
+// as it's attached; sessions with no attached id keep using the per-app
+// quota.
+var PerSessionMemoryLimit = settings.RegisterByteSizeSetting(
+	settings.ApplicationLevel,
+	"sql.stats.mem.per_session.max",
+	"the maximum amount of sql stats memory a single session (identified via "+
+		"ssmemstorage.ContextWithSessionID) may hold; 0 disables the per-session quota",
+	0,
+)
+
+// sessionIDCtxKey is the context.Value key ContextWithSessionID/
+// SessionIDFromContext store and read a session id under.
+type sessionIDCtxKey struct{}
+
+// ContextWithSessionID attaches sessionID to ctx so that a subsequent
+// RecordStatement or RecordTransaction call made with the resulting context
+// is charged against PerSessionMemoryLimit's quota for that session instead
+// of PerAppMemoryLimit's per-application quota. The session id is ignored
+// while PerSessionMemoryLimit is 0.
+func ContextWithSessionID(ctx context.Context, sessionID string) context.Context {
+	return context.WithValue(ctx, sessionIDCtxKey{}, sessionID)
+}
+
+// SessionIDFromContext returns the session id attached to ctx via
+// ContextWithSessionID, if any.
+func SessionIDFromContext(ctx context.Context) (string, bool) {
+	sessionID, ok := ctx.Value(sessionIDCtxKey{}).(string)
+	return sessionID, ok
+}
+
+// quotaMember tracks one fingerprint charged against an appQuota: how many
+// bytes it holds, the order it was last touched in (used to pick an eviction
+// victim: the lowest seq is the least-recently-used member, not merely the
+// first-inserted one, since touchLocked bumps seq on every subsequent
+// record), and how to actually remove the underlying entry from the
+// Container when it's chosen as a victim.
+type quotaMember struct {
+	seq     int64
+	bytes   int64
+	onEvict func(ctx context.Context)
+}
+
+// appQuota is the child monitor and account a single application name's
+// statement/transaction fingerprints are charged against, before spilling
+// into the Container's parent monitor. When the child monitor is full,
+// RecordStatement/RecordTransaction evict this application's own
+// least-recently-used members rather than failing outright or reaching
+// into the shared budget.
+type appQuota struct {
+	mon *mon.BytesMonitor
+	acc mon.BoundAccount
+
+	mu struct {
+		sync.Mutex
+		members map[interface{}]*quotaMember
+		nextSeq int64
+	}
+}
+
+// quotaState holds the per-app quota bookkeeping for one Container. It is
+// kept out of Container itself (see overflowSinks for the same pattern and
+// rationale).
+type quotaState struct {
+	parent *mon.BytesMonitor
+
+	mu struct {
+		sync.Mutex
+		byApp map[string]*appQuota
+	}
+}
+
+var quotaStates sync.Map // map[*Container]*quotaState
+
+// SetAppQuotaParent enables per-app memory quotas for s, with child monitors
+// started against parent, overriding the default of lazily starting child
+// monitors against s.mu.acc.Monitor() the first time a quota is needed. Tests
+// that want an isolated parent monitor (rather than the Container's own)
+// should call this before RecordStatement or RecordTransaction are invoked.
+func (s *Container) SetAppQuotaParent(parent *mon.BytesMonitor) {
+	qs := &quotaState{parent: parent}
+	qs.mu.byApp = make(map[string]*appQuota)
+	quotaStates.Store(s, qs)
+}
+
+// getQuotaState returns s's quotaState, lazily initializing one (rooted at
+// s's own monitor) the first time a per-app or per-session quota is
+// configured and needed. It returns nil when both PerAppMemoryLimit and
+// PerSessionMemoryLimit are 0, preserving the pre-quota behavior of growing
+// s.mu.acc directly.
+func (s *Container) getQuotaState() *quotaState {
+	if v, ok := quotaStates.Load(s); ok {
+		return v.(*quotaState)
+	}
+	if PerAppMemoryLimit.Get(&s.st.SV) <= 0 && PerSessionMemoryLimit.Get(&s.st.SV) <= 0 {
+		return nil
+	}
+	parent := s.mu.acc.Monitor()
+	if parent == nil {
+		return nil
+	}
+	qs := &quotaState{parent: parent}
+	qs.mu.byApp = make(map[string]*appQuota)
+	actual, _ := quotaStates.LoadOrStore(s, qs)
+	return actual.(*quotaState)
+}
+
+// quotaBucketKey decides whether appName's fingerprint should be charged
+// against a per-session bucket (when PerSessionMemoryLimit is configured and
+// ctx carries a session id attached via ContextWithSessionID) or the per-app
+// bucket keyed by appName, per the precedence documented on
+// PerSessionMemoryLimit. limit is 0 when neither quota is configured,
+// meaning the caller should fall back to growing s.mu.acc directly.
+func (s *Container) quotaBucketKey(ctx context.Context, appName string) (key string, limit int64) {
+	if sessionLimit := PerSessionMemoryLimit.Get(&s.st.SV); sessionLimit > 0 {
+		if sessionID, ok := SessionIDFromContext(ctx); ok {
+			return "session:" + sessionID, sessionLimit
+		}
+	}
+	return "app:" + appName, PerAppMemoryLimit.Get(&s.st.SV)
+}
+
+// MemoryUsageByApp returns the number of bytes of sql stats memory currently
+// held by each per-app or per-session quota bucket in use (see
+// quotaBucketKey for how a fingerprint is assigned to one or the other).
+// Buckets are only tracked once PerAppMemoryLimit or PerSessionMemoryLimit is
+// non-zero and at least one statement or transaction has been recorded
+// against them since.
+func (s *Container) MemoryUsageByApp() map[string]int64 {
+	qs := s.getQuotaState()
+	if qs == nil {
+		return nil
+	}
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	usage := make(map[string]int64, len(qs.mu.byApp))
+	for bucketKey, q := range qs.mu.byApp {
+		usage[bucketKey] = q.acc.Used()
+	}
+	return usage
+}
+
+// appQuotaLocked returns (creating if necessary) the appQuota for bucketKey.
+// qs.mu must be held.
+func (qs *quotaState) appQuotaLocked(bucketKey string, limitBytes int64) *appQuota {
+	q, ok := qs.mu.byApp[bucketKey]
+	if ok {
+		return q
+	}
+	m := mon.NewMonitorInheritWithLimit(
+		mon.MakeName("sql-stats-quota-"+bucketKey), limitBytes, qs.parent,
+	)
+	m.StartNoReserved(context.Background(), qs.parent)
+	q = &appQuota{mon: m, acc: m.MakeBoundAccount()}
+	q.mu.members = make(map[interface{}]*quotaMember)
+	qs.mu.byApp[bucketKey] = q
+	return q
+}
+
+// growWithAppQuota accounts estimatedBytes for the fingerprint identified by
+// key (a statementKey or an appstatspb.TransactionFingerprintID) against the
+// per-app or per-session quota bucket ctx/appName resolve to (see
+// quotaBucketKey). If the bucket is full, it evicts that bucket's own
+// least-recently-touched fingerprints (invoking their onEvict callback,
+// which is expected to remove them from the Container's stmts/txns map)
+// until the new entry fits, rather than reaching into the Container's
+// shared budget or rejecting the observation outright.
+//
+// If no quota is configured, this falls through to growing s.mu.acc
+// directly, preserving the pre-quota behavior, and returns a nil *appQuota
+// so the caller knows to Shrink s.mu.acc (rather than a quota account) when
+// this fingerprint is later evicted. When a quota bucket is used, the
+// returned *appQuota is the one estimatedBytes was actually charged
+// against; the caller should hold onto it (not re-derive it from
+// then-current settings) so that a later eviction shrinks the exact account
+// that was grown, even if the settings or ctx's session id have since
+// changed.
+func (s *Container) growWithAppQuota(
+	ctx context.Context,
+	appName string,
+	key interface{},
+	estimatedBytes int64,
+	onEvict func(ctx context.Context),
+) (*appQuota, error) {
+	qs := s.getQuotaState()
+	bucketKey, limit := s.quotaBucketKey(ctx, appName)
+	if qs == nil || limit <= 0 {
+		return nil, s.mu.acc.Grow(ctx, estimatedBytes)
+	}
+
+	qs.mu.Lock()
+	q := qs.appQuotaLocked(bucketKey, limit)
+	qs.mu.Unlock()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.acc.Grow(ctx, estimatedBytes); err != nil {
+		if evictErr := q.evictUntilFitsLocked(ctx, estimatedBytes); evictErr != nil {
+			return nil, evictErr
+		}
+	}
+
+	q.mu.nextSeq++
+	q.mu.members[key] = &quotaMember{seq: q.mu.nextSeq, bytes: estimatedBytes, onEvict: onEvict}
+	return q, nil
+}
+
+// touchAppQuota marks key as most-recently-used within the per-app or
+// per-session quota bucket ctx/appName resolve to (see quotaBucketKey), if
+// such a bucket is active for s and already tracking key. It's a no-op
+// otherwise (e.g. no quota is configured, or key was never charged against
+// one because the Container's memory accounting is disabled). Unlike
+// growWithAppQuota, this never grows or shrinks the account: it only
+// updates eviction order, since RecordStatement/RecordTransaction call this
+// on every record of an already-existing fingerprint, not just its
+// creation, so that a hot fingerprint isn't evicted ahead of a cold one
+// merely because it was created first.
+func (s *Container) touchAppQuota(ctx context.Context, appName string, key interface{}) {
+	qs := s.getQuotaState()
+	if qs == nil {
+		return
+	}
+	bucketKey, limit := s.quotaBucketKey(ctx, appName)
+	if limit <= 0 {
+		return
+	}
+	qs.mu.Lock()
+	q, ok := qs.mu.byApp[bucketKey]
+	qs.mu.Unlock()
+	if !ok {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if m, ok := q.mu.members[key]; ok {
+		q.mu.nextSeq++
+		m.seq = q.mu.nextSeq
+	}
+}
+
+// shrinkQuotaOrAcc credits bytes back to whichever account they were
+// actually grown against by an earlier growWithAppQuota call: usedQuota's
+// account if usedQuota is non-nil, or s.mu.acc otherwise. Callers must pass
+// the *appQuota growWithAppQuota returned at grow time, not one re-derived
+// from then-current settings, so that flipping PerAppMemoryLimit or
+// PerSessionMemoryLimit between an entry's creation and its eviction can't
+// cause this to shrink an account that never held those bytes.
+func shrinkQuotaOrAcc(ctx context.Context, s *Container, usedQuota *appQuota, bytes int64) {
+	if usedQuota == nil {
+		s.mu.acc.Shrink(ctx, bytes)
+		return
+	}
+	usedQuota.mu.Lock()
+	defer usedQuota.mu.Unlock()
+	usedQuota.acc.Shrink(ctx, bytes)
+}
+
+// evictUntilFitsLocked evicts this appQuota's least-recently-used members
+// (the ones with the lowest seq; see touchAppQuota for how seq advances on
+// every record, not just a member's creation), coldest first, until
+// estimatedBytes fits in the freed space, then grows the account by
+// estimatedBytes. q.mu must be held.
+func (q *appQuota) evictUntilFitsLocked(ctx context.Context, estimatedBytes int64) error {
+	for {
+		victimKey, victim := q.coldestMemberLocked()
+		if victim == nil {
+			// Nothing left to evict; report the original memory pressure error.
+			return q.acc.Grow(ctx, estimatedBytes)
+		}
+		victim.onEvict(ctx)
+		delete(q.mu.members, victimKey)
+		q.acc.Shrink(ctx, victim.bytes)
+
+		if err := q.acc.Grow(ctx, estimatedBytes); err == nil {
+			return nil
+		}
+	}
+}
+
+// coldestMemberLocked returns the member with the lowest sequence number
+// (i.e. the one that has gone the longest without being touched by
+// touchAppQuota, whether at its own creation or a later record), or
+// (nil, nil) if there are no members. q.mu must be held.
+func (q *appQuota) coldestMemberLocked() (interface{}, *quotaMember) {
+	var coldestKey interface{}
+	var coldest *quotaMember
+	for k, m := range q.mu.members {
+		if coldest == nil || m.seq < coldest.seq {
+			coldestKey, coldest = k, m
+		}
+	}
+	return coldestKey, coldest
+}
@@ -0,0 +1,128 @@
+// Copyright 2024 The Cockroach Authors.
+//
+// Use of this software is governed by the CockroachDB Software License
+// included in the /LICENSE file.
+
+package ssmemstorage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAppQuota(t *testing.T, limitBytes int64) *appQuota {
+	t.Helper()
+	m := mon.NewMonitorInheritWithLimit(mon.MakeName("test-app-quota"), limitBytes, nil /* parent */)
+	m.StartNoReserved(context.Background(), nil /* parent */)
+	q := &appQuota{mon: m, acc: m.MakeBoundAccount()}
+	q.mu.members = make(map[interface{}]*quotaMember)
+	return q
+}
+
+// TestAppQuotaEvictsOldestMemberFirst verifies that evictUntilFitsLocked picks
+// the least-recently-inserted member as its victim, not an arbitrary one.
+func TestAppQuotaEvictsOldestMemberFirst(t *testing.T) {
+	ctx := context.Background()
+	q := newTestAppQuota(t, 30)
+
+	var evicted []string
+	insert := func(name string, bytes int64) {
+		require.NoError(t, q.acc.Grow(ctx, bytes))
+		q.mu.nextSeq++
+		q.mu.members[name] = &quotaMember{
+			seq:   q.mu.nextSeq,
+			bytes: bytes,
+			onEvict: func(context.Context) {
+				evicted = append(evicted, name)
+			},
+		}
+	}
+	insert("a", 10)
+	insert("b", 10)
+	insert("c", 10)
+
+	// The quota is now full (30/30). Making room for one more 10-byte member
+	// should evict "a" first, since it was inserted first.
+	require.NoError(t, q.evictUntilFitsLocked(ctx, 10))
+	require.Equal(t, []string{"a"}, evicted)
+	require.Equal(t, int64(30), q.acc.Used())
+}
+
+// TestAppQuotaEvictsUntilFits verifies that evictUntilFitsLocked keeps
+// evicting, oldest first, until the requested size actually fits, rather
+// than stopping after a single eviction.
+func TestAppQuotaEvictsUntilFits(t *testing.T) {
+	ctx := context.Background()
+	q := newTestAppQuota(t, 20)
+
+	var evicted []string
+	insert := func(name string, bytes int64) {
+		require.NoError(t, q.acc.Grow(ctx, bytes))
+		q.mu.nextSeq++
+		q.mu.members[name] = &quotaMember{
+			seq:   q.mu.nextSeq,
+			bytes: bytes,
+			onEvict: func(context.Context) {
+				evicted = append(evicted, name)
+			},
+		}
+	}
+	insert("a", 10)
+	insert("b", 10)
+
+	// Making room for 20 bytes requires evicting both members.
+	require.NoError(t, q.evictUntilFitsLocked(ctx, 20))
+	require.Equal(t, []string{"a", "b"}, evicted)
+	require.Equal(t, int64(20), q.acc.Used())
+}
+
+// TestAppQuotaTouchProtectsFromEviction verifies that bumping a member's seq
+// (as touchAppQuota does on every record of an already-existing fingerprint,
+// not just its creation) protects it from being picked as the eviction
+// victim ahead of a member that was inserted later but never touched again.
+func TestAppQuotaTouchProtectsFromEviction(t *testing.T) {
+	ctx := context.Background()
+	q := newTestAppQuota(t, 20)
+
+	var evicted []string
+	insert := func(name string, bytes int64) {
+		require.NoError(t, q.acc.Grow(ctx, bytes))
+		q.mu.nextSeq++
+		q.mu.members[name] = &quotaMember{
+			seq:   q.mu.nextSeq,
+			bytes: bytes,
+			onEvict: func(context.Context) {
+				evicted = append(evicted, name)
+			},
+		}
+	}
+	insert("a", 10)
+	insert("b", 10)
+
+	// "a" was inserted first, so without a later touch it would be the
+	// eviction victim. Re-touching it (as a repeated record would) should
+	// make "b" the victim instead, even though "b" was inserted after "a".
+	q.mu.nextSeq++
+	q.mu.members["a"].seq = q.mu.nextSeq
+
+	require.NoError(t, q.evictUntilFitsLocked(ctx, 10))
+	require.Equal(t, []string{"b"}, evicted)
+	require.Equal(t, int64(10), q.acc.Used())
+}
+
+// TestAppQuotaEvictionExhaustedReturnsError verifies that once every member
+// has been evicted and the requested size still doesn't fit, the original
+// memory-pressure error surfaces rather than the call silently succeeding.
+func TestAppQuotaEvictionExhaustedReturnsError(t *testing.T) {
+	ctx := context.Background()
+	q := newTestAppQuota(t, 10)
+
+	require.NoError(t, q.acc.Grow(ctx, 10))
+	q.mu.nextSeq++
+	q.mu.members["a"] = &quotaMember{seq: q.mu.nextSeq, bytes: 10, onEvict: func(context.Context) {}}
+
+	require.Error(t, q.evictUntilFitsLocked(ctx, 1000))
+}
@@ -72,9 +72,35 @@ func (s *Container) RecordStatement(
 		createIfNonExistent,
 	)
 
+	// This means we have reached the limit of unique fingerprints. Under the
+	// lru eviction policy, make room by evicting this Container's coldest
+	// fingerprint (statement or transaction: both share one LRU list) and
+	// retry once before giving up.
+	if throttled && EvictionPolicy.Get(&s.st.SV) == evictionPolicyLRU {
+		s.mu.Lock()
+		freed := s.getOrInitLRU().evictOldest(ctx, 1, false)
+		s.mu.Unlock()
+		if freed > 0 {
+			stats, statementKey, stmtFingerprintID, created, throttled = s.getStatsForStmt(
+				key.Query,
+				key.ImplicitTxn,
+				key.Database,
+				key.PlanHash,
+				key.TransactionFingerprintID,
+				createIfNonExistent,
+			)
+		}
+	}
+
 	// This means we have reached the limit of unique fingerprintstats. We don't
-	// record anything and abort the operation.
+	// record anything and abort the operation, falling through to the
+	// disk-backed overflow log (if configured) so the observation isn't lost
+	// outright.
 	if throttled {
+		s.spillStatementToOverflow(ctx, &appstatspb.CollectedStatementStatistics{
+			Key: key,
+			ID:  stmtFingerprintID,
+		})
 		return stmtFingerprintID, ErrFingerprintLimitReached
 	}
 
@@ -148,20 +174,73 @@ func (s *Container) RecordStatement(
 		// We also account for the memory used for s.sampledPlanMetadataCache.
 		// timestamp size + key size + hash.
 		estimatedMemoryAllocBytes += timestampSize + statementKey.sampledPlanKey.size() + 8
-		s.mu.Lock()
-		defer s.mu.Unlock()
 
-		// If the monitor is nil, we do not track memory usage.
-		if s.mu.acc.Monitor() == nil {
-			return stats.ID, nil
-		}
+		// spillStats is set below, inside the critical section, when the entry
+		// has to be dropped for memory pressure. It is spilled to the overflow
+		// log (if configured) after s.mu is released below, since that spill
+		// performs disk I/O and must not stall every other statement and
+		// transaction being recorded against this Container in the meantime.
+		var spillStats *appstatspb.CollectedStatementStatistics
+		growErr := func() error {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			// If the monitor is nil, we do not track memory usage.
+			if s.mu.acc.Monitor() == nil {
+				return nil
+			}
 
-		// We attempt to account for all the memory we used. If we have exceeded our
-		// memory budget, delete the entry that we just created and report the error.
-		if err := s.mu.acc.Grow(ctx, estimatedMemoryAllocBytes); err != nil {
-			delete(s.mu.stmts, statementKey)
-			return stats.ID, ErrMemoryPressure
+			// We attempt to account for all the memory we used, against the
+			// application's own quota first (if one is configured) so that a single
+			// noisy application can't starve the rest of the budget. usedQuota is
+			// the account estimatedMemoryAllocBytes actually lands in (nil for
+			// s.mu.acc), captured here rather than re-derived from
+			// then-current settings when this entry is eventually evicted.
+			usedQuota, growErr := s.growWithAppQuota(ctx, key.App, statementKey, estimatedMemoryAllocBytes,
+				func(ctx context.Context) { delete(s.mu.stmts, statementKey) },
+			)
+			// Under the lru eviction policy, evict this Container's coldest entries
+			// to make room rather than giving up immediately.
+			if growErr != nil && EvictionPolicy.Get(&s.st.SV) == evictionPolicyLRU {
+				s.getOrInitLRU().evictOldest(ctx, estimatedMemoryAllocBytes, false)
+				usedQuota, growErr = s.growWithAppQuota(ctx, key.App, statementKey, estimatedMemoryAllocBytes,
+					func(ctx context.Context) { delete(s.mu.stmts, statementKey) },
+				)
+			}
+			// If we still have exceeded our memory budget, delete the entry that we
+			// just created and report the error; spillStats is picked up once this
+			// lock is released.
+			if growErr != nil {
+				delete(s.mu.stmts, statementKey)
+				spillStats = &appstatspb.CollectedStatementStatistics{
+					Key:   key,
+					ID:    stats.ID,
+					Stats: stats.mu.data,
+				}
+				return ErrMemoryPressure
+			}
+			s.getOrInitLRU().touch(statementKey, estimatedMemoryAllocBytes,
+				func(ctx context.Context, bytes int64) {
+					delete(s.mu.stmts, statementKey)
+					shrinkQuotaOrAcc(ctx, s, usedQuota, bytes)
+				},
+			)
+			return nil
+		}()
+		if spillStats != nil {
+			s.spillStatementToOverflow(ctx, spillStats)
 		}
+		if growErr != nil {
+			return stats.ID, growErr
+		}
+	} else {
+		// Not this fingerprint's first record: keep it from looking
+		// least-recently-used just because it was created earlier than some
+		// other, colder fingerprint. touchExisting/touchAppQuota are no-ops if
+		// this fingerprint was never charged against either (e.g. memory
+		// accounting is disabled), so it's safe to call unconditionally.
+		s.getOrInitLRU().touchExisting(statementKey)
+		s.touchAppQuota(ctx, key.App, statementKey)
 	}
 
 	return stats.ID, nil
@@ -217,7 +296,24 @@ func (s *Container) RecordTransaction(
 	// Get the statistics object.
 	stats, created, throttled := s.getStatsForTxnWithKey(key, value.StatementFingerprintIDs, true /* createIfNonexistent */)
 
+	// This means we have reached the limit of unique fingerprints. Under the
+	// lru eviction policy, make room by evicting this Container's coldest
+	// fingerprint (statement or transaction: both share one LRU list) and
+	// retry once before giving up.
+	if throttled && EvictionPolicy.Get(&s.st.SV) == evictionPolicyLRU {
+		s.mu.Lock()
+		freed := s.getOrInitLRU().evictOldest(ctx, 1, true)
+		s.mu.Unlock()
+		if freed > 0 {
+			stats, created, throttled = s.getStatsForTxnWithKey(key, value.StatementFingerprintIDs, true /* createIfNonexistent */)
+		}
+	}
+
 	if throttled {
+		s.spillTransactionToOverflow(ctx, &appstatspb.CollectedTransactionStatistics{
+			TransactionFingerprintID: key,
+			StatementFingerprintIDs:  value.StatementFingerprintIDs,
+		})
 		return ErrFingerprintLimitReached
 	}
 
@@ -233,21 +329,63 @@ func (s *Container) RecordTransaction(
 	if created {
 		estimatedMemAllocBytes :=
 			stats.sizeUnsafeLocked() + key.Size() + 8 /* hash of transaction key */
-		if err := func() error {
+
+		// spillStats is set below, inside the critical section, when the entry
+		// has to be dropped for memory pressure. It is spilled to the overflow
+		// log (if configured) after s.mu is released below, since that spill
+		// performs disk I/O and must not stall every other statement and
+		// transaction being recorded against this Container in the meantime.
+		var spillStats *appstatspb.CollectedTransactionStatistics
+		err := func() error {
 			s.mu.Lock()
 			defer s.mu.Unlock()
 
 			// If the monitor is nil, we do not track memory usage.
 			if s.mu.acc.Monitor() != nil {
-				if err := s.mu.acc.Grow(ctx, estimatedMemAllocBytes); err != nil {
+				// Account against the application's own quota first (if one is
+				// configured) so a single noisy application can't starve the rest
+				// of the budget. usedQuota is the account estimatedMemAllocBytes
+				// actually lands in (nil for s.mu.acc), captured here rather than
+				// re-derived from then-current settings when this entry is
+				// eventually evicted.
+				quotaEvict := func(ctx context.Context) { delete(s.mu.txns, key) }
+				usedQuota, growErr := s.growWithAppQuota(ctx, value.App, key, estimatedMemAllocBytes, quotaEvict)
+				// Under the lru eviction policy, evict this Container's coldest
+				// entries to make room rather than giving up immediately.
+				if growErr != nil && EvictionPolicy.Get(&s.st.SV) == evictionPolicyLRU {
+					s.getOrInitLRU().evictOldest(ctx, estimatedMemAllocBytes, true)
+					usedQuota, growErr = s.growWithAppQuota(ctx, value.App, key, estimatedMemAllocBytes, quotaEvict)
+				}
+				if growErr != nil {
 					delete(s.mu.txns, key)
+					spillStats = &appstatspb.CollectedTransactionStatistics{
+						TransactionFingerprintID: key,
+						StatementFingerprintIDs:  value.StatementFingerprintIDs,
+						Stats:                    stats.mu.data,
+					}
 					return ErrMemoryPressure
 				}
+				s.getOrInitLRU().touch(key, estimatedMemAllocBytes, func(ctx context.Context, bytes int64) {
+					delete(s.mu.txns, key)
+					shrinkQuotaOrAcc(ctx, s, usedQuota, bytes)
+				})
 			}
 			return nil
-		}(); err != nil {
+		}()
+		if spillStats != nil {
+			s.spillTransactionToOverflow(ctx, spillStats)
+		}
+		if err != nil {
 			return err
 		}
+	} else {
+		// Not this fingerprint's first record: keep it from looking
+		// least-recently-used just because it was created earlier than some
+		// other, colder fingerprint. touchExisting/touchAppQuota are no-ops if
+		// this fingerprint was never charged against either (e.g. memory
+		// accounting is disabled), so it's safe to call unconditionally.
+		s.getOrInitLRU().touchExisting(key)
+		s.touchAppQuota(ctx, value.App, key)
 	}
 
 	stats.mu.data.Count++